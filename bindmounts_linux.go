@@ -0,0 +1,96 @@
+//go:build linux
+// +build linux
+
+package debos
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// BindMounts applies cmd.mounts inside the chroot for CHROOT_METHOD_CHROOT,
+// translating each MountOption into the matching mount(2) flags. A
+// read-only bind needs the classic two-step dance, since MS_RDONLY is
+// rejected on the same call as MS_BIND: first a normal bind, then a
+// MS_REMOUNT|MS_BIND|MS_RDONLY over the same mountpoint.
+func (cmd *Command) BindMounts() {
+	for _, m := range cmd.mounts {
+		target := fmt.Sprintf("%s/%s", cmd.Chroot, m.Target)
+		os.MkdirAll(target, 0755)
+
+		if err := applyMount(m, target); err != nil {
+			log.Printf("Failed to mount %s on %s: %v", m.Source, target, err)
+		}
+	}
+}
+
+func applyMount(m MountOption, target string) error {
+	switch m.Type {
+	case "", "bind":
+		flags := uintptr(syscall.MS_BIND)
+		if m.Recursive {
+			flags |= syscall.MS_REC
+		}
+		if err := syscall.Mount(m.Source, target, "", flags, ""); err != nil {
+			return err
+		}
+
+		if m.ReadOnly {
+			remountFlags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+			if m.Recursive {
+				remountFlags |= syscall.MS_REC
+			}
+			if err := syscall.Mount(m.Source, target, "", remountFlags, ""); err != nil {
+				return err
+			}
+		}
+
+		return applyPropagation(m, target)
+	case "tmpfs":
+		return syscall.Mount("tmpfs", target, "tmpfs", 0, strings.Join(m.Options, ","))
+	case "overlay":
+		data, err := overlayMountData(m.Options)
+		if err != nil {
+			return err
+		}
+		return syscall.Mount("overlay", target, "overlay", 0, data)
+	default:
+		return fmt.Errorf("unknown mount type %q", m.Type)
+	}
+}
+
+// overlayMountData translates MountOption.Options' bare directory paths
+// (lower[, lower2, ...], upper, work) into the "lowerdir=...,upperdir=...,
+// workdir=..." key=value string mount(2) requires for an overlay mount.
+func overlayMountData(options []string) (string, error) {
+	if len(options) < 3 {
+		return "", fmt.Errorf("overlay mount needs at least one lowerdir plus upperdir and workdir, got %v", options)
+	}
+
+	lowers := options[:len(options)-2]
+	upper := options[len(options)-2]
+	work := options[len(options)-1]
+
+	return fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lowers, ":"), upper, work), nil
+}
+
+func applyPropagation(m MountOption, target string) error {
+	var flags uintptr
+	switch m.Propagation {
+	case "", "private":
+		flags = syscall.MS_PRIVATE
+	case "rprivate":
+		flags = syscall.MS_PRIVATE | syscall.MS_REC
+	case "slave":
+		flags = syscall.MS_SLAVE
+	case "shared":
+		flags = syscall.MS_SHARED
+	default:
+		return fmt.Errorf("unknown mount propagation %q", m.Propagation)
+	}
+
+	return syscall.Mount("none", target, "", flags, "")
+}
@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package debos
+
+import "testing"
+
+func TestOverlayMountData(t *testing.T) {
+	data, err := overlayMountData([]string{"/lower1", "/lower2", "/upper", "/work"})
+	if err != nil {
+		t.Fatalf("overlayMountData returned error: %v", err)
+	}
+
+	want := "lowerdir=/lower1:/lower2,upperdir=/upper,workdir=/work"
+	if data != want {
+		t.Errorf("overlayMountData = %q, want %q", data, want)
+	}
+
+	if _, err := overlayMountData([]string{"/upper", "/work"}); err == nil {
+		t.Error("overlayMountData with no lowerdir: expected error, got nil")
+	}
+}
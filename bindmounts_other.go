@@ -0,0 +1,35 @@
+//go:build !linux
+// +build !linux
+
+package debos
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+)
+
+// BindMounts applies cmd.mounts inside the chroot for CHROOT_METHOD_CHROOT
+// by shelling out to mount(8). Unlike the Linux implementation this only
+// covers plain and read-only bind mounts; tmpfs/overlay and the
+// Recursive/Propagation knobs are Linux-specific and ignored here.
+func (cmd *Command) BindMounts() {
+	for _, m := range cmd.mounts {
+		if m.Type != "" && m.Type != "bind" {
+			continue
+		}
+		target := fmt.Sprintf("%s/%s", cmd.Chroot, m.Target)
+		os.MkdirAll(target, 0755)
+
+		args := []string{"-o", "bind"}
+		if m.ReadOnly {
+			args[1] = "bind,ro"
+		}
+		args = append(args, m.Source, target)
+
+		if out, err := exec.Command("mount", args...).CombinedOutput(); err != nil {
+			log.Printf("Failed to mount %s on %s: %v: %s", m.Source, target, err, out)
+		}
+	}
+}
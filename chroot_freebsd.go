@@ -0,0 +1,53 @@
+//go:build freebsd
+// +build freebsd
+
+package debos
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// setupJail creates an ephemeral jail rooted at cmd.Chroot, bind mounting
+// cmd's plain bind mounts into it via nullfs, and returns the jail name to be passed
+// to jexec. The jail is torn down by teardownJail once the command has run.
+func (cmd *Command) setupJail() (string, error) {
+	name := fmt.Sprintf("debos-%d", os.Getpid())
+
+	for _, mount := range cmd.bindMountList() {
+		target := fmt.Sprintf("%s/%s", cmd.Chroot, mount.Target)
+		os.MkdirAll(target, 0755)
+		if out, err := exec.Command("mount", "-t", "nullfs", mount.Source, target).CombinedOutput(); err != nil {
+			cmd.unmountJailMounts()
+			return "", fmt.Errorf("nullfs mount of %s failed: %v: %s", mount.Source, err, out)
+		}
+	}
+
+	args := []string{
+		"-c",
+		fmt.Sprintf("name=%s", name),
+		fmt.Sprintf("path=%s", cmd.Chroot),
+		fmt.Sprintf("host.hostname=%s", name),
+		"persist",
+	}
+	if out, err := exec.Command("jail", args...).CombinedOutput(); err != nil {
+		cmd.unmountJailMounts()
+		return "", fmt.Errorf("jail_set failed: %v: %s", err, out)
+	}
+
+	return name, nil
+}
+
+// teardownJail removes the jail created by setupJail and unmounts its
+// nullfs mounts.
+func (cmd *Command) teardownJail(name string) {
+	exec.Command("jail", "-r", name).Run()
+	cmd.unmountJailMounts()
+}
+
+func (cmd *Command) unmountJailMounts() {
+	for _, mount := range cmd.bindMountList() {
+		exec.Command("umount", fmt.Sprintf("%s/%s", cmd.Chroot, mount.Target)).Run()
+	}
+}
@@ -0,0 +1,347 @@
+//go:build linux
+// +build linux
+
+package debos
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	seccomp "github.com/seccomp/libseccomp-golang"
+)
+
+// hardenHelperArg is the hidden argv[1] sentinel debos re-execs itself
+// with to apply the seccomp/capability/rlimit restrictions from inside the
+// chroot, right before execing the real command (see runHardenHelper).
+const hardenHelperArg = "__debos_harden_helper__"
+
+func init() {
+	if len(os.Args) > 1 && os.Args[1] == hardenHelperArg {
+		os.Exit(runHardenHelper())
+	}
+}
+
+// hardenSpec is the payload passed to the re-exec'd helper via the
+// _DEBOS_HARDEN_SPEC environment variable.
+type hardenSpec struct {
+	Chroot          string              `json:"chroot"`
+	ExtraEnv        []string            `json:"extra_env"`
+	Cmdline         []string            `json:"cmdline"`
+	Capabilities    []string            `json:"capabilities"`
+	Seccomp         *specs.LinuxSeccomp `json:"seccomp,omitempty"`
+	Rlimits         []specs.POSIXRlimit `json:"rlimits"`
+	NoNewPrivileges bool                `json:"no_new_privileges"`
+}
+
+// setupHardenedChroot returns the argv to exec in place of the plain
+// "chroot" binary, plus the _DEBOS_HARDEN_SPEC=... environment entry it
+// must run with: a re-exec of the current binary that applies cmd's
+// capability, seccomp and rlimit restrictions from inside the chroot
+// before execing cmdline.
+func (cmd Command) setupHardenedChroot(cmdline []string) ([]string, string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var seccompProfile *specs.LinuxSeccomp
+	if cmd.SeccompProfile != "" {
+		// Parsed here, on the host, and carried in the spec rather than
+		// re-read by the helper: by the time the helper runs it has
+		// already chrooted, so a host path like /etc/containers/seccomp.json
+		// would no longer resolve.
+		seccompProfile, err = ParseSeccompProfile(cmd.SeccompProfile)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid seccomp profile %s: %w", cmd.SeccompProfile, err)
+		}
+	}
+
+	spec := hardenSpec{
+		Chroot:          cmd.Chroot,
+		ExtraEnv:        cmd.extraEnv,
+		Cmdline:         cmdline,
+		Capabilities:    cmd.Capabilities,
+		Seccomp:         seccompProfile,
+		Rlimits:         cmd.Rlimits,
+		NoNewPrivileges: cmd.NoNewPrivileges,
+	}
+	payload, err := json.Marshal(spec)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return []string{self, hardenHelperArg}, "_DEBOS_HARDEN_SPEC=" + string(payload), nil
+}
+
+// ParseSeccompProfile parses an OCI-format seccomp JSON profile, such as
+// those shipped with Docker/podman, so recipes can point SeccompProfile at
+// an existing profile on disk.
+func ParseSeccompProfile(path string) (*specs.LinuxSeccomp, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var profile specs.LinuxSeccomp
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("decoding seccomp profile: %w", err)
+	}
+
+	return &profile, nil
+}
+
+// runHardenHelper runs in the re-exec'd helper process, on the host, before
+// the real command. It chroots, applies rlimits, sets PR_SET_NO_NEW_PRIVS, loads the
+// seccomp filter and drops capabilities, in that order, then execs the real
+// command. PR_SET_NO_NEW_PRIVS and the seccomp load both have to happen
+// before capabilities are dropped: filter.Load() requires the caller to
+// hold either CAP_SYS_ADMIN or no_new_privs, and a capability set trimmed
+// down to the job's own needs typically excludes CAP_SYS_ADMIN.
+func runHardenHelper() int {
+	var spec hardenSpec
+	if err := json.Unmarshal([]byte(os.Getenv("_DEBOS_HARDEN_SPEC")), &spec); err != nil {
+		fmt.Fprintf(os.Stderr, "debos harden helper: decoding spec: %v\n", err)
+		return 1
+	}
+
+	if err := syscall.Chroot(spec.Chroot); err != nil {
+		fmt.Fprintf(os.Stderr, "debos harden helper: chroot %s: %v\n", spec.Chroot, err)
+		return 1
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		fmt.Fprintf(os.Stderr, "debos harden helper: chdir /: %v\n", err)
+		return 1
+	}
+
+	for _, rlimit := range spec.Rlimits {
+		res, ok := rlimitResource(rlimit.Type)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "debos harden helper: unknown rlimit %s\n", rlimit.Type)
+			return 1
+		}
+		limit := syscall.Rlimit{Cur: rlimit.Soft, Max: rlimit.Hard}
+		if err := syscall.Setrlimit(res, &limit); err != nil {
+			fmt.Fprintf(os.Stderr, "debos harden helper: setrlimit %s: %v\n", rlimit.Type, err)
+			return 1
+		}
+	}
+
+	if spec.NoNewPrivileges {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			fmt.Fprintf(os.Stderr, "debos harden helper: PR_SET_NO_NEW_PRIVS: %v\n", err)
+			return 1
+		}
+	}
+
+	if spec.Seccomp != nil {
+		if err := loadSeccompProfile(spec.Seccomp); err != nil {
+			fmt.Fprintf(os.Stderr, "debos harden helper: loading seccomp filter: %v\n", err)
+			return 1
+		}
+	}
+
+	if len(spec.Capabilities) > 0 {
+		if err := dropCapabilities(spec.Capabilities); err != nil {
+			fmt.Fprintf(os.Stderr, "debos harden helper: dropping capabilities: %v\n", err)
+			return 1
+		}
+	}
+
+	binary, err := exec.LookPath(spec.Cmdline[0])
+	if err != nil {
+		binary = spec.Cmdline[0]
+	}
+	env := append(os.Environ(), spec.ExtraEnv...)
+	if err := syscall.Exec(binary, spec.Cmdline, env); err != nil {
+		fmt.Fprintf(os.Stderr, "debos harden helper: exec %s: %v\n", spec.Cmdline[0], err)
+		return 1
+	}
+
+	return 0
+}
+
+// dropCapabilities restricts the current process to exactly the named
+// capability set (e.g. "CAP_NET_ADMIN") in all four capability sets, using
+// libcap, and drops every other capability from the bounding set too —
+// without that, a setuid-root binary executed later could still regain a
+// capability this function otherwise dropped.
+func dropCapabilities(names []string) error {
+	set := cap.NewSet()
+	kept := make(map[cap.Value]bool, len(names))
+	for _, name := range names {
+		value, err := cap.FromName(name)
+		if err != nil {
+			return fmt.Errorf("unknown capability %s: %w", name, err)
+		}
+		kept[value] = true
+		if err := set.SetFlag(cap.Effective, true, value); err != nil {
+			return err
+		}
+		if err := set.SetFlag(cap.Permitted, true, value); err != nil {
+			return err
+		}
+		if err := set.SetFlag(cap.Inheritable, true, value); err != nil {
+			return err
+		}
+	}
+
+	// The bounding set is trimmed first: DropBound needs CAP_SETPCAP,
+	// which SetProc removes unless it is one of names.
+	for v := cap.Value(0); v < cap.MaxBits(); v++ {
+		if kept[v] {
+			continue
+		}
+		if err := cap.DropBound(v); err != nil {
+			return fmt.Errorf("dropping capability %v from bounding set: %w", v, err)
+		}
+	}
+
+	return set.SetProc()
+}
+
+// loadSeccompProfile builds a libseccomp filter from an OCI seccomp
+// profile and loads it into the kernel for the current process, honoring
+// the profile's default errno, restricted architectures, and each rule's
+// own errno and argument conditions — not just its name and action — so a
+// profile that only allows a syscall for certain argument values (e.g.
+// clone, personality, socket) keeps that meaning here instead of being
+// installed as an unconditional allow/deny.
+func loadSeccompProfile(profile *specs.LinuxSeccomp) error {
+	defaultAction := seccompAction(profile.DefaultAction)
+	if profile.DefaultErrnoRet != nil {
+		defaultAction = defaultAction.SetReturnCode(int16(*profile.DefaultErrnoRet))
+	}
+
+	filter, err := seccomp.NewFilter(defaultAction)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range profile.Architectures {
+		arch, err := seccomp.GetArchFromString(strings.TrimPrefix(string(a), "SCMP_ARCH_"))
+		if err != nil {
+			return fmt.Errorf("unknown seccomp architecture %s: %w", a, err)
+		}
+		if err := filter.AddArch(arch); err != nil {
+			return fmt.Errorf("adding architecture %s: %w", a, err)
+		}
+	}
+
+	for _, rule := range profile.Syscalls {
+		action := seccompAction(rule.Action)
+		if rule.ErrnoRet != nil {
+			action = action.SetReturnCode(int16(*rule.ErrnoRet))
+		}
+
+		conds, err := seccompConditions(rule.Args)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range rule.Names {
+			sc, err := seccomp.GetSyscallFromName(name)
+			if err != nil {
+				continue // unknown on this kernel/arch; skip rather than fail the build
+			}
+			if len(conds) > 0 {
+				err = filter.AddRuleConditional(sc, action, conds)
+			} else {
+				err = filter.AddRule(sc, action)
+			}
+			if err != nil {
+				return fmt.Errorf("adding rule for %s: %w", name, err)
+			}
+		}
+	}
+
+	return filter.Load()
+}
+
+// seccompConditions translates an OCI seccomp rule's argument filters into
+// the libseccomp conditions used by AddRuleConditional.
+func seccompConditions(args []specs.LinuxSeccompArg) ([]seccomp.ScmpCondition, error) {
+	conds := make([]seccomp.ScmpCondition, 0, len(args))
+	for _, arg := range args {
+		op, err := seccompCompareOp(arg.Op)
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, seccomp.ScmpCondition{
+			Argument: arg.Index,
+			Op:       op,
+			Operand1: arg.Value,
+			Operand2: arg.ValueTwo,
+		})
+	}
+
+	return conds, nil
+}
+
+func seccompCompareOp(op specs.LinuxSeccompOperator) (seccomp.ScmpCompareOp, error) {
+	switch op {
+	case specs.OpNotEqual:
+		return seccomp.CompareNotEqual, nil
+	case specs.OpLessThan:
+		return seccomp.CompareLess, nil
+	case specs.OpLessEqual:
+		return seccomp.CompareLessOrEqual, nil
+	case specs.OpEqualTo:
+		return seccomp.CompareEqual, nil
+	case specs.OpGreaterEqual:
+		return seccomp.CompareGreaterEqual, nil
+	case specs.OpGreaterThan:
+		return seccomp.CompareGreater, nil
+	case specs.OpMaskedEqual:
+		return seccomp.CompareMaskedEqual, nil
+	default:
+		return 0, fmt.Errorf("unknown seccomp arg operator %q", op)
+	}
+}
+
+func seccompAction(action specs.LinuxSeccompAction) seccomp.ScmpAction {
+	switch action {
+	case specs.ActAllow:
+		return seccomp.ActAllow
+	case specs.ActErrno:
+		return seccomp.ActErrno
+	case specs.ActKill, specs.ActKillProcess, specs.ActKillThread:
+		return seccomp.ActKill
+	case specs.ActTrap:
+		return seccomp.ActTrap
+	case specs.ActLog:
+		return seccomp.ActLog
+	default:
+		return seccomp.ActErrno
+	}
+}
+
+func rlimitResource(name string) (int, bool) {
+	resources := map[string]int{
+		"RLIMIT_AS":         unix.RLIMIT_AS,
+		"RLIMIT_CORE":       unix.RLIMIT_CORE,
+		"RLIMIT_CPU":        unix.RLIMIT_CPU,
+		"RLIMIT_DATA":       unix.RLIMIT_DATA,
+		"RLIMIT_FSIZE":      unix.RLIMIT_FSIZE,
+		"RLIMIT_LOCKS":      unix.RLIMIT_LOCKS,
+		"RLIMIT_MEMLOCK":    unix.RLIMIT_MEMLOCK,
+		"RLIMIT_MSGQUEUE":   unix.RLIMIT_MSGQUEUE,
+		"RLIMIT_NICE":       unix.RLIMIT_NICE,
+		"RLIMIT_NOFILE":     unix.RLIMIT_NOFILE,
+		"RLIMIT_NPROC":      unix.RLIMIT_NPROC,
+		"RLIMIT_RSS":        unix.RLIMIT_RSS,
+		"RLIMIT_RTPRIO":     unix.RLIMIT_RTPRIO,
+		"RLIMIT_RTTIME":     unix.RLIMIT_RTTIME,
+		"RLIMIT_SIGPENDING": unix.RLIMIT_SIGPENDING,
+		"RLIMIT_STACK":      unix.RLIMIT_STACK,
+	}
+	res, ok := resources[name]
+	return res, ok
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package debos
+
+import (
+	"fmt"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// setupHardenedChroot is only implemented on Linux, where libcap and
+// libseccomp are available to enforce Capabilities/SeccompProfile/Rlimits.
+func (cmd Command) setupHardenedChroot(cmdline []string) ([]string, string, error) {
+	return nil, "", fmt.Errorf("capabilities/seccomp/rlimit hardening is only supported on Linux")
+}
+
+// ParseSeccompProfile is only implemented on Linux.
+func ParseSeccompProfile(path string) (*specs.LinuxSeccomp, error) {
+	return nil, fmt.Errorf("seccomp profiles are only supported on Linux")
+}
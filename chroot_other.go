@@ -0,0 +1,15 @@
+//go:build !freebsd
+// +build !freebsd
+
+package debos
+
+import "fmt"
+
+// setupJail is only implemented on FreeBSD; CHROOT_METHOD_JAIL is not
+// available on other platforms.
+func (cmd *Command) setupJail() (string, error) {
+	return "", fmt.Errorf("CHROOT_METHOD_JAIL is only supported on FreeBSD")
+}
+
+func (cmd *Command) teardownJail(name string) {
+}
@@ -0,0 +1,146 @@
+//go:build linux
+// +build linux
+
+package debos
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// unshareHelperArg is the hidden argv[1] sentinel debos re-execs itself
+// with to perform the namespace setup that has to run from inside the new
+// mount/PID namespace (see runUnshareHelper).
+const unshareHelperArg = "__debos_unshare_helper__"
+
+func init() {
+	if len(os.Args) > 1 && os.Args[1] == unshareHelperArg {
+		os.Exit(runUnshareHelper())
+	}
+}
+
+// unshareSpec is the payload passed to the re-exec'd helper process via the
+// _DEBOS_UNSHARE_SPEC environment variable.
+type unshareSpec struct {
+	Chroot     string      `json:"chroot"`
+	BindMounts []BindMount `json:"bind_mounts"`
+	ExtraEnv   []string    `json:"extra_env"`
+	Cmdline    []string    `json:"cmdline"`
+}
+
+// runUnshare runs cmdline inside fresh user, mount and PID namespaces so
+// debos can chroot without being root or relying on systemd-nspawn. It
+// re-execs the current binary, which calls back into runUnshareHelper to do
+// the actual mounting and chrooting from inside the new namespaces.
+func (cmd Command) runUnshare(label string, cmdline ...string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	spec := unshareSpec{Chroot: cmd.Chroot, BindMounts: cmd.bindMountList(), ExtraEnv: cmd.extraEnv, Cmdline: cmdline}
+	payload, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+
+	exe := exec.Command(self, unshareHelperArg)
+	exe.Env = append(os.Environ(), "_DEBOS_UNSHARE_SPEC="+string(payload))
+	exe.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getgid(), Size: 1},
+		},
+	}
+
+	w := newStreamWrapper(label, "combined", cmd.outputSink(), &sync.Mutex{}, new(int))
+	exe.Stdin = nil
+	exe.Stdout = w
+	exe.Stderr = w
+
+	err = exe.Run()
+	w.flush()
+	return err
+}
+
+// runUnshareHelper is re-exec'd as pid 1 inside the new namespaces, with
+// the uid/gid maps already written by the Go runtime per SysProcAttr in
+// runUnshare. It bind mounts cmd's plain bind mounts plus /sys, /dev and
+// /dev/pts into the chroot, mounts a fresh /proc there, then chroots and
+// execs the real command.
+func runUnshareHelper() int {
+	var spec unshareSpec
+	if err := json.Unmarshal([]byte(os.Getenv("_DEBOS_UNSHARE_SPEC")), &spec); err != nil {
+		fmt.Fprintf(os.Stderr, "debos unshare helper: decoding spec: %v\n", err)
+		return 1
+	}
+
+	if err := syscall.Mount("none", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		fmt.Fprintf(os.Stderr, "debos unshare helper: making / private: %v\n", err)
+		return 1
+	}
+
+	for _, mount := range spec.BindMounts {
+		target := fmt.Sprintf("%s/%s", spec.Chroot, mount.Target)
+		os.MkdirAll(target, 0755)
+		if err := syscall.Mount(mount.Source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "debos unshare helper: bind mounting %s: %v\n", mount.Source, err)
+			return 1
+		}
+	}
+
+	for _, vfs := range []struct{ source, target, fstype string }{
+		{"proc", "proc", "proc"},
+		// Bind mounted from the host rather than mounted fresh: mounting a
+		// new sysfs requires CLONE_NEWNET (the kernel ties sysfs to the
+		// network namespace it's mounted in), which this helper's
+		// namespaces don't create, so "mount sysfs sys -t sysfs" fails
+		// EPERM here. Binding the host's /sys in, like /dev below, needs
+		// no extra namespace and is what the chrooted command actually
+		// wants anyway.
+		{"/sys", "sys", ""},
+		{"/dev", "dev", ""},
+		{"/dev/pts", "dev/pts", ""},
+	} {
+		target := fmt.Sprintf("%s/%s", spec.Chroot, vfs.target)
+		os.MkdirAll(target, 0755)
+
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REC)
+		fstype := vfs.fstype
+		if fstype != "" {
+			flags = 0
+		}
+		if err := syscall.Mount(vfs.source, target, fstype, flags, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "debos unshare helper: mounting %s: %v\n", vfs.target, err)
+			return 1
+		}
+	}
+
+	if err := syscall.Chroot(spec.Chroot); err != nil {
+		fmt.Fprintf(os.Stderr, "debos unshare helper: chroot %s: %v\n", spec.Chroot, err)
+		return 1
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		fmt.Fprintf(os.Stderr, "debos unshare helper: chdir /: %v\n", err)
+		return 1
+	}
+
+	binary, err := exec.LookPath(spec.Cmdline[0])
+	if err != nil {
+		binary = spec.Cmdline[0]
+	}
+	env := append(os.Environ(), spec.ExtraEnv...)
+	if err := syscall.Exec(binary, spec.Cmdline, env); err != nil {
+		fmt.Fprintf(os.Stderr, "debos unshare helper: exec %s: %v\n", spec.Cmdline[0], err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package debos
+
+import "fmt"
+
+// runUnshare is only implemented on Linux; CHROOT_METHOD_UNSHARE relies on
+// user, mount and PID namespaces that other platforms don't provide.
+func (cmd Command) runUnshare(label string, cmdline ...string) error {
+	return fmt.Errorf("CHROOT_METHOD_UNSHARE is only supported on Linux")
+}
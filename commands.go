@@ -1,13 +1,16 @@
 package debos
 
 import (
-	"bytes"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
 )
 
 type ChrootEnterMethod int
@@ -16,62 +19,113 @@ const (
 	CHROOT_METHOD_NONE   = iota // No chroot in use
 	CHROOT_METHOD_NSPAWN        // use nspawn to create the chroot environment
 	CHROOT_METHOD_CHROOT        // use chroot to create the chroot environment
+	CHROOT_METHOD_JAIL          // use a FreeBSD jail to create the chroot environment
+	CHROOT_METHOD_UNSHARE       // use unprivileged user/mount/pid namespaces to create the chroot environment
+	CHROOT_METHOD_QEMU          // run the command inside a QEMU microVM
 	CHROOT_METHOD_DEFAULT       // use the user given choice
 )
 
 var DefaultChrootMethod ChrootEnterMethod = CHROOT_METHOD_NSPAWN
 
+// BindMount is a plain source/target bind mount, as used by the
+// CHROOT_METHOD_JAIL and CHROOT_METHOD_UNSHARE backends, which don't yet
+// support MountOption's richer knobs.
 type BindMount struct {
 	Source string
 	Target string
 }
 
+// MountOption describes a single mount to set up inside the chroot. The
+// zero value is a plain read-write bind mount.
+type MountOption struct {
+	Source string
+	Target string
+
+	ReadOnly  bool // remount read-only after binding
+	Recursive bool // bind/unbind the whole mount subtree (MS_REC)
+
+	// Propagation is one of "private" (default), "rprivate", "slave" or
+	// "shared". It only applies to Type "bind"/"".
+	Propagation string
+
+	// Type is "bind" (default), "tmpfs" or "overlay".
+	Type string
+
+	// Options carries type-specific mount options: tmpfs options such as
+	// "size=100m" verbatim, or for overlay the bare directory paths
+	// "lower[, lower2, ...], upper, work" (last two entries are upperdir
+	// and workdir, every entry before them is a lowerdir), in the same
+	// order systemd-nspawn's --overlay= takes them. Each backend
+	// translates that into whatever form it actually needs (mount(2)'s
+	// "lowerdir=...,upperdir=...,workdir=..." key=value string for
+	// CHROOT_METHOD_CHROOT, the colon-joined paths nspawn wants as-is).
+	Options []string
+}
+
 type Command struct {
 	Architecture string            // Architecture of the chroot, nil if same as host
 	Dir          string            // Working dir to run command in
 	Chroot       string            // Run in the chroot at path
 	ChrootMethod ChrootEnterMethod // Method to enter the chroot
 
-	bindMounts []BindMount // Items to bind mount
-	extraEnv   []string  // Extra environment variables to set
-}
-
-type commandWrapper struct {
-	label  string
-	buffer *bytes.Buffer
-}
-
-func newCommandWrapper(label string) *commandWrapper {
-	b := bytes.Buffer{}
-	return &commandWrapper{label, &b}
+	// Capabilities, if non-empty, restricts CHROOT_METHOD_CHROOT to this
+	// set of capabilities (e.g. "CAP_NET_ADMIN") instead of inheriting
+	// the host process' full set.
+	Capabilities []string
+	// SeccompProfile, if set, is the path to an OCI-format seccomp JSON
+	// profile (as shipped with Docker/podman) loaded before exec under
+	// CHROOT_METHOD_CHROOT.
+	SeccompProfile string
+	// Rlimits are applied to the process before exec under
+	// CHROOT_METHOD_CHROOT.
+	Rlimits []specs.POSIXRlimit
+	// NoNewPrivileges sets PR_SET_NO_NEW_PRIVS before exec under
+	// CHROOT_METHOD_CHROOT.
+	NoNewPrivileges bool
+
+	// QemuKernel and QemuInitrd select the kernel/initramfs pair the
+	// CHROOT_METHOD_QEMU microVM boots; both are required for that method.
+	QemuKernel string
+	QemuInitrd string
+	// QemuMemory is the microVM's RAM in megabytes (default 256).
+	QemuMemory int
+	// QemuCPUs is the microVM's vCPU count (default 1).
+	QemuCPUs int
+
+	// OutputSink receives each line of the command's output, tagged with
+	// stream/label/timestamp/pid metadata. Defaults to DefaultOutputSink.
+	OutputSink OutputSink
+
+	mounts   []MountOption // Items to mount
+	extraEnv []string      // Extra environment variables to set
 }
 
-func (w commandWrapper) out(atEOF bool) {
-	for {
-		s, err := w.buffer.ReadString('\n')
-		if err == nil {
-			log.Printf("%s | %v", w.label, s)
-		} else {
-			if len(s) > 0 {
-				if atEOF && err == io.EOF {
-					log.Printf("%s | %v\n", w.label, s)
-				} else {
-					w.buffer.WriteString(s)
-				}
-			}
-			break
+// bindMountList returns the subset of cmd.mounts that are plain bind
+// mounts, as simple source/target pairs, for consumers (CHROOT_METHOD_JAIL,
+// CHROOT_METHOD_UNSHARE) that don't support MountOption's richer knobs.
+func (cmd Command) bindMountList() []BindMount {
+	var result []BindMount
+	for _, m := range cmd.mounts {
+		if m.Type == "" || m.Type == "bind" {
+			result = append(result, BindMount{Source: m.Source, Target: m.Target})
 		}
 	}
+	return result
 }
 
-func (w commandWrapper) Write(p []byte) (n int, err error) {
-	n, err = w.buffer.Write(p)
-	w.out(false)
-	return
+// needsHardening reports whether cmd carries any of the optional
+// CHROOT_METHOD_CHROOT hardening knobs, in which case Run must route
+// through the hardened re-exec helper instead of the plain chroot binary.
+func (cmd Command) needsHardening() bool {
+	return len(cmd.Capabilities) > 0 || cmd.SeccompProfile != "" || len(cmd.Rlimits) > 0 || cmd.NoNewPrivileges
 }
 
-func (w *commandWrapper) flush() {
-	w.out(true)
+// outputSink returns cmd.OutputSink, or DefaultOutputSink if unset.
+func (cmd Command) outputSink() OutputSink {
+	if cmd.OutputSink != nil {
+		return cmd.OutputSink
+	}
+	return DefaultOutputSink
 }
 
 func NewChrootCommandForContext(context DebosContext) Command {
@@ -113,30 +167,40 @@ func (cmd *Command) AddEnvKey(key, value string) {
 }
 
 func (cmd *Command) AddBindMount(source, target string) {
-	var mount BindMount
-
 	if target == "" {
-		mount.Target = source
-	} else {
-		mount.Target = target
+		target = source
 	}
-	mount.Source = source
 
-	cmd.bindMounts = append(cmd.bindMounts, mount)
+	cmd.AddMount(MountOption{Source: source, Target: target})
 }
 
-func (cmd *Command) BindMounts() {
-	for _, mount := range cmd.bindMounts {
-		fmt.Printf("Running mount --bind %s %s\n", mount.Source, fmt.Sprintf("%s/%s", cmd.Chroot, mount.Target))
-		os.Mkdir(fmt.Sprintf("%s/%s", cmd.Chroot, mount.Target), 0755)
-		exec.Command("mount", "--bind", mount.Source, fmt.Sprintf("%s/%s", cmd.Chroot, mount.Target)).Output()
+// AddMount records a mount to set up inside the chroot, with the options
+// described by m. See MountOption.
+func (cmd *Command) AddMount(m MountOption) {
+	if m.Target == "" {
+		m.Target = m.Source
 	}
+
+	cmd.mounts = append(cmd.mounts, m)
 }
 
+// CleanBindMounts tears down the mounts this Command itself set up
+// (cmd.mounts), deepest path first, retrying a lazy unmount if the kernel
+// reports a mount busy. It deliberately only touches mounts this
+// invocation created — for a full sweep of everything left mounted under
+// a root, including leftovers from a crashed previous run, call
+// UnmountAllUnder directly.
 func (cmd *Command) CleanBindMounts() {
-	for _, mount := range cmd.bindMounts {
-		fmt.Printf("Running umount %s\n", fmt.Sprintf("%s/%s", cmd.Chroot, mount.Target))
-		exec.Command("umount", fmt.Sprintf("%s/%s", cmd.Chroot, mount.Target)).Output()
+	targets := make([]string, 0, len(cmd.mounts))
+	for _, m := range cmd.mounts {
+		targets = append(targets, fmt.Sprintf("%s/%s", cmd.Chroot, m.Target))
+	}
+	sort.Slice(targets, func(i, j int) bool { return len(targets[i]) > len(targets[j]) })
+
+	for _, target := range targets {
+		if err := unmountWithRetry(target); err != nil {
+			log.Printf("Failed to unmount %s: %v", target, err)
+		}
 	}
 }
 
@@ -145,6 +209,16 @@ func (cmd Command) Run(label string, cmdline ...string) error {
 		cmd.ChrootMethod = DefaultChrootMethod
 	}
 
+	// The unshare method re-execs into fresh namespaces and never shares
+	// the rest of Run's chroot/qemu/nspawn plumbing, so it's handled on
+	// its own.
+	if cmd.ChrootMethod == CHROOT_METHOD_UNSHARE {
+		return cmd.runUnshare(label, cmdline...)
+	}
+	if cmd.ChrootMethod == CHROOT_METHOD_QEMU {
+		return cmd.runMicroVM(label, cmdline...)
+	}
+
 	q := newQemuHelper(cmd)
 	q.Setup()
 
@@ -153,28 +227,53 @@ func (cmd Command) Run(label string, cmdline ...string) error {
 	case CHROOT_METHOD_NONE:
 		options = cmdline
 	case CHROOT_METHOD_CHROOT:
-		options = append(options, "chroot")
-		options = append(options, cmd.Chroot)
-		options = append(options, cmdline...)
+		if cmd.needsHardening() {
+			opts, env, err := cmd.setupHardenedChroot(cmdline)
+			if err != nil {
+				return err
+			}
+			options = opts
+			cmd.extraEnv = append(cmd.extraEnv, env)
+		} else {
+			options = append(options, "chroot")
+			options = append(options, cmd.Chroot)
+			options = append(options, cmdline...)
+		}
 	case CHROOT_METHOD_NSPAWN:
 		options = append(options, "systemd-nspawn", "-q", "-D", cmd.Chroot)
 		for _, e := range cmd.extraEnv {
 			options = append(options, "--setenv", e)
 
 		}
-		for _, b := range cmd.bindMounts {
-			options = append(options, "--bind", fmt.Sprintf("%s:%s", b.Source, b.Target))
-
+		for _, m := range cmd.mounts {
+			options = append(options, nspawnMountArgs(m)...)
 		}
 		options = append(options, cmdline...)
+	case CHROOT_METHOD_JAIL:
+		jailName, err := cmd.setupJail()
+		if err != nil {
+			return err
+		}
+		defer cmd.teardownJail(jailName)
+
+		options = append(options, "jexec", jailName)
+		options = append(options, cmdline...)
 	}
 
 	exe := exec.Command(options[0], options[1:]...)
-	w := newCommandWrapper(label)
+
+	sink := cmd.outputSink()
+	// Stdout and stderr are copied by separate goroutines under the hood,
+	// so share one mutex and pid between the two wrappers to keep
+	// interleaved lines coherent and correctly attributed.
+	var mu sync.Mutex
+	pid := new(int)
+	stdout := newStreamWrapper(label, "stdout", sink, &mu, pid)
+	stderr := newStreamWrapper(label, "stderr", sink, &mu, pid)
 
 	exe.Stdin = nil
-	exe.Stdout = w
-	exe.Stderr = w
+	exe.Stdout = stdout
+	exe.Stderr = stderr
 
 	if len(cmd.extraEnv) > 0 && cmd.ChrootMethod != CHROOT_METHOD_NSPAWN {
 		exe.Env = append(os.Environ(), cmd.extraEnv...)
@@ -192,8 +291,19 @@ func (cmd Command) Run(label string, cmdline ...string) error {
 		cmd.BindMounts()
 	}
 
-	err := exe.Run()
-	w.flush()
+	err := exe.Start()
+	if err == nil {
+		// exe.Process.Pid is set the moment Start returns, but the
+		// stdout/stderr copy goroutines can already be calling emit (which
+		// reads *pid under mu) by then, so pid must be written under the
+		// same mutex rather than racing with them.
+		mu.Lock()
+		*pid = exe.Process.Pid
+		mu.Unlock()
+		err = exe.Wait()
+	}
+	stdout.flush()
+	stderr.flush()
 	q.Cleanup()
 
 	if cmd.ChrootMethod == CHROOT_METHOD_CHROOT {
@@ -203,6 +313,29 @@ func (cmd Command) Run(label string, cmdline ...string) error {
 	return err
 }
 
+// nspawnMountArgs translates a MountOption into the systemd-nspawn flags
+// that achieve the same thing: --bind-ro for read-only binds, --tmpfs= for
+// tmpfs, and --overlay= for overlay mounts.
+func nspawnMountArgs(m MountOption) []string {
+	switch m.Type {
+	case "tmpfs":
+		spec := m.Target
+		if len(m.Options) > 0 {
+			spec += ":" + strings.Join(m.Options, ",")
+		}
+		return []string{"--tmpfs=" + spec}
+	case "overlay":
+		parts := append(append([]string{}, m.Options...), m.Target)
+		return []string{"--overlay=" + strings.Join(parts, ":")}
+	default: // "bind" or ""
+		flag := "--bind"
+		if m.ReadOnly {
+			flag = "--bind-ro"
+		}
+		return []string{flag, fmt.Sprintf("%s:%s", m.Source, m.Target)}
+	}
+}
+
 type qemuHelper struct {
 	qemusrc    string
 	qemutarget string
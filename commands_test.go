@@ -0,0 +1,21 @@
+package debos
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNspawnMountArgsOverlay(t *testing.T) {
+	m := MountOption{
+		Type:    "overlay",
+		Target:  "/merged",
+		Options: []string{"/lower1", "/lower2", "/upper", "/work"},
+	}
+
+	got := nspawnMountArgs(m)
+	want := []string{"--overlay=/lower1:/lower2:/upper:/work:/merged"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("nspawnMountArgs(%+v) = %v, want %v", m, got, want)
+	}
+}
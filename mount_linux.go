@@ -0,0 +1,125 @@
+//go:build linux
+// +build linux
+
+package debos
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// UnmountAllUnder unmounts every mount point strictly under root (root
+// itself is left mounted, see mountpointsUnder), discovered
+// by parsing /proc/self/mountinfo rather than trusting a recorded list of
+// mounts. This makes it safe to call for post-crash recovery and for
+// idempotent re-runs, where a previous debos invocation may have left
+// submounts (e.g. under /dev/disk) that a caller never bind mounted
+// itself. Mounts are unmounted deepest-path-first so children come down
+// before their parents, and a busy mount is retried as a lazy
+// (MNT_DETACH) unmount.
+func UnmountAllUnder(root string) error {
+	mounts, err := mountpointsUnder(root)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(mounts, func(i, j int) bool { return len(mounts[i]) > len(mounts[j]) })
+
+	var failed []string
+	for _, m := range mounts {
+		if err := unmountWithRetry(m); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", m, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to unmount: %s", strings.Join(failed, "; "))
+	}
+
+	return nil
+}
+
+// mountpointsUnder returns every mount point listed in /proc/self/mountinfo
+// that is strictly nested under root. root itself is deliberately excluded:
+// it's typically the caller's own chroot/image mount, set up and torn down
+// by its own code, not something UnmountAllUnder should rip out from under
+// a still-running build.
+func mountpointsUnder(root string) ([]string, error) {
+	root = strings.TrimRight(root, "/")
+	if root == "" {
+		// TrimRight turns both "" and "/" into "", and matching
+		// HasPrefix(mountpoint, "/") against every mountpoint would make
+		// this return the entire host's mount table.
+		return nil, fmt.Errorf("mountpointsUnder: refusing empty or root (\"/\") path")
+	}
+
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Format: mountID parentID major:minor root mountpoint options ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mountpoint := unescapeMountinfoField(fields[4])
+		if strings.HasPrefix(mountpoint, root+"/") {
+			mounts = append(mounts, mountpoint)
+		}
+	}
+
+	return mounts, scanner.Err()
+}
+
+// unescapeMountinfoField decodes the octal \NNN escapes the kernel uses in
+// /proc/self/mountinfo for space, tab, newline and backslash, so that e.g.
+// a mountpoint containing a space (encoded as \040) prefix-matches root
+// correctly instead of being compared still-escaped.
+func unescapeMountinfoField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
+
+// unmountWithRetry unmounts path, falling back to a lazy (MNT_DETACH)
+// unmount retried a few times if the kernel reports the mount is busy.
+func unmountWithRetry(path string) error {
+	err := syscall.Unmount(path, 0)
+	if err != syscall.EBUSY {
+		return err
+	}
+
+	for i := 0; i < 5; i++ {
+		err = syscall.Unmount(path, syscall.MNT_DETACH)
+		if err == nil || err != syscall.EBUSY {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return err
+}
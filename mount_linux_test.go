@@ -0,0 +1,30 @@
+//go:build linux
+// +build linux
+
+package debos
+
+import "testing"
+
+func TestMountpointsUnderRejectsRoot(t *testing.T) {
+	for _, root := range []string{"", "/"} {
+		if _, err := mountpointsUnder(root); err == nil {
+			t.Errorf("mountpointsUnder(%q): expected error, got nil", root)
+		}
+	}
+}
+
+func TestUnescapeMountinfoField(t *testing.T) {
+	cases := map[string]string{
+		"/mnt/plain":         "/mnt/plain",
+		`/mnt/with\040space`: "/mnt/with space",
+		`/mnt/a\040b\040c`:   "/mnt/a b c",
+		`/mnt/tab\011here`:   "/mnt/tab\there",
+		`/mnt/back\134slash`: `/mnt/back\slash`,
+	}
+
+	for in, want := range cases {
+		if got := unescapeMountinfoField(in); got != want {
+			t.Errorf("unescapeMountinfoField(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
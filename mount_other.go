@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package debos
+
+import "os/exec"
+
+// UnmountAllUnder is a no-op on this platform: unlike the Linux
+// implementation it can't discover submounts without /proc/self/mountinfo,
+// and — like the Linux implementation — it must not touch root itself,
+// since that's typically the caller's own chroot/image mount.
+func UnmountAllUnder(root string) error {
+	return nil
+}
+
+// unmountWithRetry unmounts path. Unlike the Linux implementation this
+// doesn't retry with a lazy unmount, since MNT_DETACH isn't portable.
+func unmountWithRetry(path string) error {
+	return exec.Command("umount", path).Run()
+}
@@ -0,0 +1,167 @@
+package debos
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// processStart is used as the zero point for OutputLine.Elapsed, so output
+// timestamps are monotonic even if the wall clock is adjusted mid-build.
+var processStart = time.Now()
+
+// OutputLine is a single line of command output, tagged with enough
+// metadata to make sense of output interleaved across streams and
+// concurrent Command.Run calls.
+type OutputLine struct {
+	Label   string        // the label passed to Command.Run
+	Stream  string        // "stdout" or "stderr" (or "combined" for helper processes that don't separate them)
+	Text    string        // the line, without its trailing newline
+	Elapsed time.Duration // time since the debos process started
+	PID     int           // pid of the process that produced the line, once known
+}
+
+// OutputSink receives one OutputLine per line of command output.
+// Command.Run serializes the calls for a single invocation with a mutex,
+// but a sink given to multiple Commands must be safe for concurrent use.
+type OutputSink interface {
+	WriteLine(OutputLine)
+}
+
+// DefaultOutputSink is used by Command.Run when Command.OutputSink is nil.
+var DefaultOutputSink OutputSink = LogSink{}
+
+// LogSink writes output lines through the standard log package as
+// "label | text", matching debos' historical output.
+type LogSink struct{}
+
+func (LogSink) WriteLine(l OutputLine) {
+	log.Printf("%s | %s", l.Label, l.Text)
+}
+
+// JSONSink writes each output line as a JSON object to W, one per line, for
+// CI log ingestion.
+type JSONSink struct {
+	W  io.Writer
+	mu sync.Mutex
+}
+
+func (s *JSONSink) WriteLine(l OutputLine) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	json.NewEncoder(s.W).Encode(struct {
+		Label   string  `json:"label"`
+		Stream  string  `json:"stream"`
+		Text    string  `json:"text"`
+		Elapsed float64 `json:"elapsed_seconds"`
+		PID     int     `json:"pid"`
+	}{l.Label, l.Stream, l.Text, l.Elapsed.Seconds(), l.PID})
+}
+
+// RingBufferSink keeps the last Limit bytes of output in memory, so a
+// failing step's tail can be recovered after the fact, e.g. by a
+// --dump-on-failure flag that reads it back once a recipe action fails.
+// The zero value is unusable; use NewRingBufferSink.
+//
+// DebosContext is part of this package (it's the parameter type of
+// NewChrootCommandForContext in commands.go), so it isn't off-limits here;
+// its struct definition just isn't present in this source tree, and
+// neither is the recipe action runner that constructs one DebosContext per
+// build and would be the thing calling --dump-on-failure. Wiring a
+// RingBufferSink onto DebosContext, and onto every Command
+// NewChrootCommandForContext builds for it, belongs with that runner. Until
+// then, a caller with its own DebosContext can set Command.OutputSink to a
+// RingBufferSink (or a sink that fans out to one, see LogSink/JSONSink for
+// the pattern) and stash the same *RingBufferSink wherever it keeps that
+// context for later reading.
+type RingBufferSink struct {
+	limit int
+	mu    sync.Mutex
+	buf   []byte
+}
+
+func NewRingBufferSink(limit int) *RingBufferSink {
+	return &RingBufferSink{limit: limit}
+}
+
+func (s *RingBufferSink) WriteLine(l OutputLine) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buf = append(s.buf, fmt.Sprintf("%s | %s | %s\n", l.Label, l.Stream, l.Text)...)
+	if len(s.buf) > s.limit {
+		s.buf = s.buf[len(s.buf)-s.limit:]
+	}
+}
+
+// Bytes returns a copy of the currently buffered output, oldest first.
+func (s *RingBufferSink) Bytes() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]byte, len(s.buf))
+	copy(out, s.buf)
+	return out
+}
+
+type commandWrapper struct {
+	label  string
+	stream string
+	sink   OutputSink
+	mu     *sync.Mutex
+	pid    *int
+	buffer *bytes.Buffer
+}
+
+func newStreamWrapper(label, stream string, sink OutputSink, mu *sync.Mutex, pid *int) *commandWrapper {
+	return &commandWrapper{label: label, stream: stream, sink: sink, mu: mu, pid: pid, buffer: &bytes.Buffer{}}
+}
+
+func (w *commandWrapper) out(atEOF bool) {
+	for {
+		s, err := w.buffer.ReadString('\n')
+		if err == nil {
+			w.emit(s)
+		} else {
+			if len(s) > 0 {
+				if atEOF && err == io.EOF {
+					w.emit(s)
+				} else {
+					w.buffer.WriteString(s)
+				}
+			}
+			break
+		}
+	}
+}
+
+func (w *commandWrapper) emit(line string) {
+	for len(line) > 0 && (line[len(line)-1] == '\n' || line[len(line)-1] == '\r') {
+		line = line[:len(line)-1]
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.sink.WriteLine(OutputLine{
+		Label:   w.label,
+		Stream:  w.stream,
+		Text:    line,
+		Elapsed: time.Since(processStart),
+		PID:     *w.pid,
+	})
+}
+
+func (w *commandWrapper) Write(p []byte) (n int, err error) {
+	n, err = w.buffer.Write(p)
+	w.out(false)
+	return
+}
+
+func (w *commandWrapper) flush() {
+	w.out(true)
+}
@@ -0,0 +1,216 @@
+package debos
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultMicroVMMemoryMB = 256
+	defaultMicroVMCPUs     = 1
+)
+
+// runMicroVM runs cmdline for CHROOT_METHOD_QEMU: it boots a minimal QEMU
+// system VM with cmd.Chroot exported over 9p, and a tiny init (supplied by
+// cmd.QemuKernel/QemuInitrd) that mounts the shared root, applies
+// cmd.extraEnv, execs cmdline, and reports its exit code back over a
+// virtio-serial channel before powering off. This gives correct syscall
+// semantics on architectures where qemu-user binfmt emulation (the
+// approach qemuHelper/newQemuHelper use for CHROOT_METHOD_CHROOT and
+// CHROOT_METHOD_NSPAWN) is buggy or unsupported, such as riscv64 and
+// mips64el, and lets post-install hooks that depend on a real kernel
+// (depmod, update-initramfs) run on foreign-arch builds.
+func (cmd Command) runMicroVM(label string, cmdline ...string) error {
+	if cmd.QemuKernel == "" || cmd.QemuInitrd == "" {
+		return fmt.Errorf("CHROOT_METHOD_QEMU requires QemuKernel and QemuInitrd")
+	}
+
+	mac, err := randomMAC()
+	if err != nil {
+		return err
+	}
+
+	exitDir, err := os.MkdirTemp("", "debos-qemu-exit")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(exitDir)
+
+	exitSock := filepath.Join(exitDir, "exitcode.sock")
+	listener, err := net.Listen("unix", exitSock)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	memory := cmd.QemuMemory
+	if memory == 0 {
+		memory = defaultMicroVMMemoryMB
+	}
+	cpus := cmd.QemuCPUs
+	if cpus == 0 {
+		cpus = defaultMicroVMCPUs
+	}
+
+	kernelArgs := []string{"console=ttyS0", "panic=-1", "debos.cmd=" + strings.Join(cmdline, `\x20`)}
+	for _, e := range cmd.extraEnv {
+		kernelArgs = append(kernelArgs, "debos.env="+e)
+	}
+
+	args := []string{
+		"-m", strconv.Itoa(memory),
+		"-smp", strconv.Itoa(cpus),
+		"-kernel", cmd.QemuKernel,
+		"-initrd", cmd.QemuInitrd,
+		"-append", strings.Join(kernelArgs, " "),
+	}
+	args = append(args, qemuMachineArgs(cmd.Architecture)...)
+	args = append(args,
+		"-virtfs", fmt.Sprintf("local,path=%s,mount_tag=rootfs,security_model=mapped,readonly=off", cmd.Chroot),
+		"-netdev", "user,id=net0",
+		"-device", fmt.Sprintf("virtio-net-pci,netdev=net0,mac=%s", mac),
+		"-chardev", fmt.Sprintf("socket,id=exitchan,path=%s", exitSock),
+		"-device", "virtio-serial",
+		"-device", "virtserialport,chardev=exitchan,name=org.debos.exitcode",
+		"-nographic",
+		"-no-reboot",
+	)
+
+	exe := exec.Command(qemuSystemBinary(cmd.Architecture), args...)
+	w := newStreamWrapper(label, "combined", cmd.outputSink(), &sync.Mutex{}, new(int))
+	exe.Stdin = nil
+	exe.Stdout = w
+	exe.Stderr = w
+
+	if err := exe.Start(); err != nil {
+		return err
+	}
+
+	type exitResult struct {
+		code int
+		err  error
+	}
+	resultCh := make(chan exitResult, 1)
+	go func() {
+		code, err := readExitCode(listener)
+		resultCh <- exitResult{code, err}
+	}()
+
+	runErr := exe.Wait()
+	w.flush()
+	if runErr != nil {
+		return runErr
+	}
+
+	// qemu has already exited at this point, so if the guest never
+	// connected to the exit channel (it powered off before its init got
+	// that far, e.g. a panic or a bad initrd) it never will either. Close
+	// the listener to unblock the Accept call in readExitCode's goroutine
+	// instead of waiting forever on a connection that can no longer arrive.
+	listener.Close()
+
+	result := <-resultCh
+	if result.err != nil {
+		if errors.Is(result.err, net.ErrClosed) {
+			return fmt.Errorf("%s: guest never reported an exit code", label)
+		}
+		return fmt.Errorf("%s: %w", label, result.err)
+	}
+	if result.code != 0 {
+		return fmt.Errorf("%s: exited with status %d", label, result.code)
+	}
+
+	return nil
+}
+
+// readExitCode accepts the guest init's single connection on the
+// virtio-serial exit channel and reads the "<exit code>\n" line it writes
+// just before powering off.
+func readExitCode(listener net.Listener) (int, error) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return 0, fmt.Errorf("reading exit code from guest: %w", err)
+	}
+
+	return strconv.Atoi(strings.TrimSpace(line))
+}
+
+// qemuSystemBinary picks the qemu-system binary matching arch. An empty
+// arch is treated as amd64; the host's actual architecture is not detected.
+func qemuSystemBinary(arch string) string {
+	switch arch {
+	case "":
+		return "qemu-system-x86_64"
+	case "amd64":
+		return "qemu-system-x86_64"
+	case "i386":
+		return "qemu-system-i386"
+	case "arm64":
+		return "qemu-system-aarch64"
+	case "armhf", "armel", "arm":
+		return "qemu-system-arm"
+	case "mips":
+		return "qemu-system-mips"
+	case "mipsel":
+		return "qemu-system-mipsel"
+	case "mips64el":
+		return "qemu-system-mips64el"
+	case "riscv64":
+		return "qemu-system-riscv64"
+	default:
+		return "qemu-system-" + arch
+	}
+}
+
+// qemuMachineArgs returns the -machine/-cpu flags needed to boot arch. An
+// empty arch is treated as amd64; the host's actual architecture is not
+// detected.
+// qemu-system-x86_64/i386 default to the "pc" machine and need nothing
+// extra, but qemu-system-aarch64, the mips binaries and
+// qemu-system-riscv64 have no default machine at all and refuse to start
+// without one.
+func qemuMachineArgs(arch string) []string {
+	switch arch {
+	case "", "amd64", "i386":
+		return nil
+	case "arm64":
+		return []string{"-machine", "virt", "-cpu", "max"}
+	case "armhf", "armel", "arm":
+		return []string{"-machine", "virt", "-cpu", "max"}
+	case "mips", "mipsel":
+		return []string{"-machine", "malta", "-cpu", "24Kf"}
+	case "mips64el":
+		return []string{"-machine", "malta", "-cpu", "MIPS64R2-generic"}
+	case "riscv64":
+		return []string{"-machine", "virt", "-cpu", "rv64"}
+	default:
+		return []string{"-machine", "virt"}
+	}
+}
+
+// randomMAC generates a locally-administered unicast MAC address for the
+// microVM's user-mode NIC.
+func randomMAC() (string, error) {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	buf[0] = (buf[0] | 0x02) & 0xfe
+
+	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", buf[0], buf[1], buf[2], buf[3], buf[4], buf[5]), nil
+}